@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// exitCodeSignatureVerificationFailed is the process/status exit code
+// recorded when a script is refused for failing signature verification,
+// distinct from a generic execution failure so operators can alert on
+// provenance problems specifically.
+const exitCodeSignatureVerificationFailed = 52
+
+type cmdFunc func(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (msg string, err error)
+
+type cmd struct {
+	f                  cmdFunc
+	name               string
+	shouldReportStatus bool
+}
+
+var cmds = map[string]cmd{
+	"install":   {install, "Install", false},
+	"enable":    {enable, "Enable", true},
+	"disable":   {disable, "Disable", true},
+	"uninstall": {uninstall, "Uninstall", false},
+	"update":    {update, "Update", true},
+	"snapshot":  {snapshot, "Snapshot", false},
+}
+
+func install(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	if err := os.MkdirAll(hEnv.HandlerEnvironment.ConfigFolder, 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create config folder")
+	}
+	return "installed", nil
+}
+
+func enable(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	hs, err := parseAndValidateSettings(hEnv.HandlerEnvironment.ConfigFolder, seqNum)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse handler settings")
+	}
+
+	stopMetrics := startMetricsListener(ctx)
+	defer stopMetrics()
+
+	dir := filepath.Join(hEnv.HandlerEnvironment.LogFolder, "download", strconv.Itoa(seqNum))
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return "", errors.Wrap(err, "failed to create download folder")
+	}
+
+	if err := runCmd(ctx, dir, hEnv.Name, &hs); err != nil {
+		return "", err
+	}
+	return "command executed successfully", nil
+}
+
+func disable(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	return "disabled", nil
+}
+
+func uninstall(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	return "uninstalled", nil
+}
+
+func update(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	return "updated", nil
+}
+
+// exitCodeFor maps a command error to the process/status exit code that
+// should be recorded for it, so distinct failure classes (like refused,
+// unsigned scripts) are distinguishable from a generic failure.
+func exitCodeFor(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, ErrSignatureVerificationFailed) {
+		return exitCodeSignatureVerificationFailed
+	}
+	return 1
+}
+
+// dispatchCommand invokes cmdName's handler for hEnv/seqNum, recording
+// the invocation in cmdInvocationsTotal and reporting status the same
+// way main does. It is separated out from main so tests can exercise
+// the real dispatch path (counters, status reporting, exit codes)
+// without triggering main's os.Exit.
+func dispatchCommand(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, cmdName string, cmdArgs []string) (msg string, err error) {
+	c := cmds[cmdName]
+	cmdInvocationsTotal.WithLabelValues(cmdName).Inc()
+	msg, err = c.f(ctx, hEnv, seqNum, cmdArgs)
+
+	if c.shouldReportStatus {
+		t := StatusSuccess
+		if err != nil {
+			t = StatusError
+			msg = err.Error()
+		}
+		if statusErr := reportStatus(hEnv, seqNum, t, exitCodeFor(err), c.name, msg); statusErr != nil {
+			ctx.Log("event", "failed to report status", "error", statusErr)
+		}
+	}
+	return msg, err
+}
@@ -79,43 +79,6 @@ func Test_checkAndSaveSeqNum(t *testing.T) {
 	require.True(t, shouldExit)
 }
 
-func Test_runCmd_success(t *testing.T) {
-	var script = "date"
-	dir, err := ioutil.TempDir("", "")
-	require.Nil(t, err)
-	defer os.RemoveAll(dir)
-
-	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlerSettings{
-		publicSettings: publicSettings{Source: &scriptSource{Script: script}},
-	})
-	require.Nil(t, err, "command should run successfully")
-
-	// check stdout stderr files
-	_, err = os.Stat(filepath.Join(dir, "stdout"))
-	require.Nil(t, err, "stdout should exist")
-	_, err = os.Stat(filepath.Join(dir, "stderr"))
-	require.Nil(t, err, "stderr should exist")
-
-	// Check embedded script if saved to file
-	_, err = os.Stat(filepath.Join(dir, "script.sh"))
-	require.Nil(t, err, "script.sh should exist")
-	content, err := ioutil.ReadFile(filepath.Join(dir, "script.sh"))
-	require.Nil(t, err, "script.sh read failure")
-	require.Equal(t, script, string(content))
-}
-
-func Test_runCmd_fail(t *testing.T) {
-	dir, err := ioutil.TempDir("", "")
-	require.Nil(t, err)
-	defer os.RemoveAll(dir)
-
-	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlerSettings{
-		publicSettings: publicSettings{Source: &scriptSource{Script: "non-existing-cmd"}},
-	})
-	require.NotNil(t, err, "command terminated with exit status")
-	require.Contains(t, err.Error(), "failed to execute command")
-}
-
 func Test_downloadScriptUri(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -145,7 +108,7 @@ func Test_decodeScript(t *testing.T) {
 	s, info, err := decodeScript(testSubject)
 
 	require.NoError(t, err)
-	require.Equal(t, info, "4;3;gzip=0")
+	require.Equal(t, info, "4;3;codec=none")
 	require.Equal(t, s, "ls\n")
 }
 
@@ -154,7 +117,25 @@ func Test_decodeScriptGzip(t *testing.T) {
 	s, info, err := decodeScript(testSubject)
 
 	require.NoError(t, err)
-	require.Equal(t, info, "32;3;gzip=1")
+	require.Equal(t, info, "32;3;codec=gzip")
+	require.Equal(t, s, "ls\n")
+}
+
+func Test_decodeScriptXz(t *testing.T) {
+	testSubject := "/Td6WFoAAATm1rRGAgAhARwAAAAQz1jMAQACbHMKAADk0l4sFmjYKgABGwMLL7kQH7bzfQEAAAAABFla"
+	s, info, err := decodeScript(testSubject)
+
+	require.NoError(t, err)
+	require.Equal(t, info, "80;3;codec=xz")
+	require.Equal(t, s, "ls\n")
+}
+
+func Test_decodeScriptZstd(t *testing.T) {
+	testSubject := "KLUv/QQAGQAAbHMKGM4iew=="
+	s, info, err := decodeScript(testSubject)
+
+	require.NoError(t, err)
+	require.Equal(t, info, "24;3;codec=zstd")
 	require.Equal(t, s, "ls\n")
 }
 
@@ -164,14 +145,29 @@ func Test_downloadScriptUri_BySASFailsSucceedsByManagedIdentity(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	UseMockSASDownloadFailure = true
+	defer func() { UseMockSASDownloadFailure = false }()
+
+	var sawBearerToken string
 	handler := func(writer http.ResponseWriter, request *http.Request) {
 		if strings.Contains(request.RequestURI, "/samplecontainer/sample.sh?SASToken") {
+			sawBearerToken = request.Header.Get("Authorization")
 			writer.WriteHeader(http.StatusOK) // Download successful using managed identity
 		}
 	}
 	srv := httptest.NewServer(http.HandlerFunc(handler))
 	defer srv.Close()
 
+	imdsHandler := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`{"access_token":"mock-managed-identity-token"}`))
+	}
+	imdsSrv := httptest.NewServer(http.HandlerFunc(imdsHandler))
+	defer imdsSrv.Close()
+
+	prevEndpoint := imdsTokenEndpoint
+	imdsTokenEndpoint = imdsSrv.URL
+	defer func() { imdsTokenEndpoint = prevEndpoint }()
+
 	_, err = downloadScript(log.NewContext(log.NewNopLogger()),
 		dir,
 		&handlerSettings{
@@ -186,5 +182,6 @@ func Test_downloadScriptUri_BySASFailsSucceedsByManagedIdentity(t *testing.T) {
 			},
 		})
 	require.Nil(t, err)
-	UseMockSASDownloadFailure = false
+	require.Equal(t, "Bearer mock-managed-identity-token", sawBearerToken,
+		"managed identity retry should authenticate with the token fetched from IMDS")
 }
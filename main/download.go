@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// UseMockSASDownloadFailure forces downloadScript's SAS-token download
+// attempt to fail so tests can exercise the managed-identity fallback
+// without needing a real, expiring SAS token.
+var UseMockSASDownloadFailure = false
+
+// imdsTokenEndpoint is the Azure Instance Metadata Service endpoint used
+// to obtain a managed identity access token. Overridable in tests.
+var imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// downloadScript retrieves hs.Source.ScriptURI into dir and returns the
+// path it was saved to. It first tries hs.SourceSASToken (already part
+// of the URI's query string); if that request fails and a managed
+// identity is configured, it falls back to an identity-authenticated
+// retry of the same URI.
+func downloadScript(ctx *log.Context, dir string, hs *handlerSettings) (string, error) {
+	uri := hs.Source.ScriptURI
+
+	scriptDownloadAttemptsTotal.WithLabelValues("sas").Inc()
+	fp, err := downloadAndSave(dir, uri, "", "sas")
+	if err == nil {
+		return fp, nil
+	}
+	scriptDownloadFailuresTotal.WithLabelValues("sas").Inc()
+
+	if hs.SourceManagedIdentity == nil {
+		return "", errors.Wrap(err, "failed to download script")
+	}
+	ctx.Log("event", "download by SAS token failed, retrying via managed identity", "error", err)
+
+	token, tokenErr := fetchManagedIdentityToken(hs.SourceManagedIdentity)
+	if tokenErr != nil {
+		ctx.Log("event", "failed to obtain managed identity token, retrying unauthenticated", "error", tokenErr)
+	}
+	scriptDownloadAttemptsTotal.WithLabelValues("managed_identity").Inc()
+	fp, err = downloadAndSave(dir, uri, token, "managed_identity")
+	if err != nil {
+		scriptDownloadFailuresTotal.WithLabelValues("managed_identity").Inc()
+	}
+	return fp, err
+}
+
+// downloadAndSave fetches uri (optionally with a bearer token) and saves
+// the response body under dir, named after the URI's final path segment.
+// authMode identifies which of downloadScript's attempts this is ("sas"
+// or "managed_identity") so UseMockSASDownloadFailure can target the
+// initial SAS attempt only, without also shadowing a managed-identity
+// retry that happens to carry no bearer token (e.g. because IMDS is
+// unreachable in the environment).
+func downloadAndSave(dir, uri, bearerToken, authMode string) (string, error) {
+	if UseMockSASDownloadFailure && authMode == "sas" {
+		return "", errors.New("mock SAS token download failure")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to build download request")
+	}
+	if bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download script")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to download script: unexpected status code %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read downloaded script")
+	}
+
+	fp := filepath.Join(dir, filepath.Base(uri))
+	if idx := indexOfQuery(fp); idx >= 0 {
+		fp = fp[:idx]
+	}
+	if err := ioutil.WriteFile(fp, b, 0744); err != nil {
+		return "", errors.Wrap(err, "failed to save downloaded script")
+	}
+	return fp, nil
+}
+
+// indexOfQuery returns the index of the first '?' in s, or -1.
+func indexOfQuery(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '?' {
+			return i
+		}
+	}
+	return -1
+}
+
+// fetchManagedIdentityToken obtains an OAuth access token for the given
+// managed identity from the Azure Instance Metadata Service.
+func fetchManagedIdentityToken(mi *RunCommandManagedIdentity) (string, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+
+	url := imdsTokenEndpoint + "?api-version=2018-02-01&resource=https://storage.azure.com/"
+	if mi.ClientId != "" {
+		url += "&client_id=" + mi.ClientId
+	}
+	if mi.ObjectId != "" {
+		url += "&object_id=" + mi.ObjectId
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "IMDS request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("IMDS returned unexpected status code %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrap(err, "failed to parse IMDS response")
+	}
+	return body.AccessToken, nil
+}
+
+// decodeScript base64-decodes s and, if the resulting bytes look
+// compressed, decompresses them. gzip, xz, and zstd are recognized by
+// their magic header bytes. It returns the final script text alongside
+// an info string of the form "<encodedLen>;<decodedLen>;codec=<name>"
+// useful for diagnostic logging.
+func decodeScript(s string) (string, string, error) {
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		scriptDecodeFailuresTotal.WithLabelValues("unknown").Inc()
+		return "", "", errors.Wrap(err, "failed to base64-decode script")
+	}
+
+	codec := sniffCodec(d)
+	content := d
+	switch codec {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(d))
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to open gzip reader")
+		}
+		defer r.Close()
+		content, err = ioutil.ReadAll(r)
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to decompress gzip script")
+		}
+	case "xz":
+		r, err := xz.NewReader(bytes.NewReader(d))
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to open xz reader")
+		}
+		content, err = ioutil.ReadAll(r)
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to decompress xz script")
+		}
+	case "zstd":
+		r, err := zstd.NewReader(bytes.NewReader(d))
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to open zstd reader")
+		}
+		defer r.Close()
+		content, err = ioutil.ReadAll(r)
+		if err != nil {
+			scriptDecodeFailuresTotal.WithLabelValues(codec).Inc()
+			return "", "", errors.Wrap(err, "failed to decompress zstd script")
+		}
+	}
+
+	info := fmt.Sprintf("%d;%d;codec=%s", len(s), len(content), codec)
+	return string(content), info, nil
+}
+
+// sniffCodec identifies a compression codec from d's magic header
+// bytes, returning "none" when d doesn't match a known one.
+func sniffCodec(d []byte) string {
+	switch {
+	case len(d) >= 2 && d[0] == 0x1f && d[1] == 0x8b:
+		return "gzip"
+	case len(d) >= 6 && bytes.Equal(d[:6], []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}):
+		return "xz"
+	case len(d) >= 4 && bytes.Equal(d[:4], []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	default:
+		return "none"
+	}
+}
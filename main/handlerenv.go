@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const handlerEnvFileName = "HandlerEnvironment.json"
+
+// HandlerEnvironment describes the folder layout the extension runs
+// under, as handed down by the Azure guest agent in
+// HandlerEnvironment.json.
+type HandlerEnvironment struct {
+	Version            float64 `json:"version"`
+	Name               string  `json:"name"`
+	HandlerEnvironment struct {
+		HeartbeatFile string `json:"heartbeatFile"`
+		StatusFolder  string `json:"statusFolder"`
+		ConfigFolder  string `json:"configFolder"`
+		LogFolder     string `json:"logFolder"`
+	} `json:"handlerEnvironment"`
+}
+
+// ParseHandlerEnv locates and parses HandlerEnvironment.json in the
+// current working directory.
+func ParseHandlerEnv() (HandlerEnvironment, error) {
+	contents, err := ioutil.ReadFile(handlerEnvFileName)
+	if err != nil {
+		return HandlerEnvironment{}, errors.Wrapf(err, "failed to read %s", handlerEnvFileName)
+	}
+
+	var envs []HandlerEnvironment
+	if err := json.Unmarshal(contents, &envs); err != nil {
+		return HandlerEnvironment{}, errors.Wrapf(err, "failed to parse %s", handlerEnvFileName)
+	}
+	if len(envs) != 1 {
+		return HandlerEnvironment{}, errors.Errorf("expected 1 config in %s, found %d", handlerEnvFileName, len(envs))
+	}
+	return envs[0], nil
+}
+
+func (h HandlerEnvironment) statusFilePath(seqNum int) string {
+	return filepath.Join(h.HandlerEnvironment.StatusFolder, fmt.Sprintf("%d.status", seqNum))
+}
+
+func (h HandlerEnvironment) settingsFilePath(seqNum int) string {
+	return filepath.Join(h.HandlerEnvironment.ConfigFolder, fmt.Sprintf("%d.settings", seqNum))
+}
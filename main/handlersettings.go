@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// waagentCertsDir is where the guest agent places the certificate/key
+// pair used to decrypt protectedSettings, named by thumbprint.
+// Overridable in tests.
+var waagentCertsDir = "/var/lib/waagent"
+
+// SignatureAlgorithm selects how a script's detached signature is
+// verified against the operator-supplied trust set.
+type SignatureAlgorithm string
+
+const (
+	// SignatureAlgorithmGPG verifies an OpenPGP detached signature
+	// against one or more ASCII-armored public keys.
+	SignatureAlgorithmGPG SignatureAlgorithm = "gpg"
+	// SignatureAlgorithmCosignEd25519 verifies a raw Ed25519 signature
+	// of the kind cosign produces for blob artifacts.
+	SignatureAlgorithmCosignEd25519 SignatureAlgorithm = "cosign-ed25519"
+)
+
+// scriptSource describes where the script to execute comes from, and
+// optionally where its detached signature can be found.
+type scriptSource struct {
+	// Script is the literal, plain-text script body.
+	Script string `json:"script"`
+	// ScriptBase64 is a base64-encoded (optionally gzip-, xz- or zstd-compressed)
+	// script body, for payloads that don't survive as plain JSON text.
+	ScriptBase64 string `json:"scriptBase64"`
+	// ScriptURI is a URI to download the script from, authenticated via
+	// SourceSASToken and/or SourceManagedIdentity.
+	ScriptURI string `json:"scriptUri"`
+
+	// SourceSignatureURI is a URI to download a detached signature of
+	// the script bytes from. Mutually exclusive with SignatureBase64.
+	SourceSignatureURI string `json:"sourceSignatureUri"`
+	// SignatureBase64 is an inline, base64-encoded detached signature
+	// of the script bytes. Mutually exclusive with SourceSignatureURI.
+	SignatureBase64 string `json:"signatureBase64"`
+}
+
+// RunCommandManagedIdentity identifies the managed identity to use when
+// downloading ScriptURI, falling back to the system-assigned identity
+// when ClientId and ObjectId are both empty.
+type RunCommandManagedIdentity struct {
+	ClientId string `json:"clientId"`
+	ObjectId string `json:"objectId"`
+}
+
+type publicSettings struct {
+	Source           *scriptSource `json:"source"`
+	TimeoutInSeconds int           `json:"timeoutInSeconds"`
+}
+
+type protectedSettings struct {
+	SourceSASToken        string                     `json:"sourceSASToken"`
+	SourceManagedIdentity *RunCommandManagedIdentity `json:"sourceManagedIdentity"`
+
+	// TrustedPublicKeys lists the ASCII-armored PGP public keys (for
+	// SignatureAlgorithmGPG) or base64/PEM-encoded Ed25519 public keys
+	// (for SignatureAlgorithmCosignEd25519) a script's signature must
+	// validate against. Verification runs only when the source carries a
+	// signature; a signature with no keys configured here is an error.
+	TrustedPublicKeys []string `json:"trustedPublicKeys"`
+	// SignatureAlgorithm selects how TrustedPublicKeys are interpreted.
+	// Defaults to SignatureAlgorithmGPG when a signature is present but
+	// this is left unset.
+	SignatureAlgorithm SignatureAlgorithm `json:"signatureAlgorithm"`
+}
+
+// handlerSettings is the merged view of the public and protected
+// settings blocks handed to the extension by the guest agent.
+type handlerSettings struct {
+	publicSettings
+	protectedSettings
+}
+
+// settingsFile mirrors the N.settings JSON the guest agent writes to
+// the handler's config folder.
+type settingsFile struct {
+	RuntimeSettings []struct {
+		HandlerSettings struct {
+			ProtectedSettingsBase64    string          `json:"protectedSettings"`
+			ProtectedSettingsCertThumb string          `json:"protectedSettingsCertThumbprint"`
+			PublicSettings             json.RawMessage `json:"publicSettings"`
+		} `json:"handlerSettings"`
+	} `json:"runtimeSettings"`
+}
+
+// parseAndValidateSettings reads seqNum's N.settings file out of
+// configFolder, decrypts the protectedSettings block using the
+// certificate waagent provisioned for this VM, and validates the
+// result.
+func parseAndValidateSettings(configFolder string, seqNum int) (h handlerSettings, _ error) {
+	fp := filepath.Join(configFolder, settingsFileName(seqNum))
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return h, errors.Wrapf(err, "failed to read %s", fp)
+	}
+
+	var f settingsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return h, errors.Wrap(err, "failed to parse settings file")
+	}
+	if len(f.RuntimeSettings) != 1 {
+		return h, errors.Errorf("expected 1 runtimeSettings entry, got %d", len(f.RuntimeSettings))
+	}
+	rs := f.RuntimeSettings[0].HandlerSettings
+
+	if len(rs.PublicSettings) > 0 {
+		if err := json.Unmarshal(rs.PublicSettings, &h.publicSettings); err != nil {
+			return h, errors.Wrap(err, "failed to parse publicSettings")
+		}
+	}
+
+	if rs.ProtectedSettingsBase64 != "" {
+		decrypted, err := decryptProtectedSettings(rs.ProtectedSettingsBase64, rs.ProtectedSettingsCertThumb)
+		if err != nil {
+			return h, errors.Wrap(err, "failed to decrypt protectedSettings")
+		}
+		if err := json.Unmarshal(decrypted, &h.protectedSettings); err != nil {
+			return h, errors.Wrap(err, "failed to parse protectedSettings")
+		}
+	}
+
+	if h.Source == nil {
+		return h, errors.New("handler settings: 'source' is required")
+	}
+	return h, nil
+}
+
+func settingsFileName(seqNum int) string {
+	return strconv.Itoa(seqNum) + ".settings"
+}
+
+// decryptProtectedSettings shells out to openssl to undo the CMS/PKCS#7
+// envelope the guest agent wraps protectedSettings in, the same way
+// waagent's own extension handlers do.
+func decryptProtectedSettings(b64, thumbprint string) ([]byte, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, errors.Wrap(err, "protectedSettings is not valid base64")
+	}
+
+	certFile := filepath.Join(waagentCertsDir, thumbprint+".crt")
+	keyFile := filepath.Join(waagentCertsDir, thumbprint+".prv")
+
+	cmd := exec.Command("openssl", "smime", "-inform", "DER", "-decrypt",
+		"-recip", certFile, "-inkey", keyFile)
+	cmd.Stdin = bytes.NewReader(der)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "openssl smime decrypt failed: %s", stderr.String())
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+)
+
+const seqNumFileName = "seqnum"
+
+// handlerVersion is the extension version recorded in diagnostic
+// snapshots; bump it alongside the packaged extension manifest version.
+const handlerVersion = "1.0"
+
+func main() {
+	logger := log.NewLogfmtLogger(os.Stderr)
+	ctx := log.NewContext(logger).With("time", log.DefaultTimestampUTC)
+
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: run-command-handler <command> [args]")
+		os.Exit(2)
+	}
+	cmdName := os.Args[1]
+	cmdArgs := os.Args[2:]
+
+	c, ok := cmds[cmdName]
+	if !ok {
+		fmt.Printf("incorrect command: %q\n", cmdName)
+		os.Exit(2)
+	}
+	ctx = ctx.With("operation", c.name)
+
+	hEnv, err := ParseHandlerEnv()
+	if err != nil {
+		ctx.Log("event", "failed to parse handler environment", "error", err)
+		os.Exit(1)
+	}
+
+	seqNum, _ := strconv.Atoi(os.Getenv("ConfigSequenceNumber"))
+	ctx = ctx.With("seq", seqNum)
+
+	// snapshot is a read-only diagnostic command, not a lifecycle event,
+	// so it must not perturb the sequence-number bookkeeping that gates
+	// "enable" re-runs.
+	if cmdName != "snapshot" {
+		seqNumFilePath := filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, seqNumFileName)
+		shouldExit, err := checkAndSaveSeqNum(ctx, seqNum, seqNumFilePath)
+		if err != nil {
+			ctx.Log("event", "failed to check sequence number", "error", err)
+			os.Exit(1)
+		}
+		if shouldExit && cmdName == "enable" {
+			ctx.Log("event", "sequence number already processed, exiting")
+			return
+		}
+	}
+
+	_, cmdErr := dispatchCommand(ctx, hEnv, seqNum, cmdName, cmdArgs)
+
+	if cmdErr != nil {
+		ctx.Log("event", "command failed", "error", cmdErr)
+		os.Exit(exitCodeFor(cmdErr))
+	}
+}
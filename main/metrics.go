@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsAddrEnvVar names the environment variable that, when set to a
+// listen address (e.g. "127.0.0.1:9090"), causes enable to expose a
+// Prometheus /metrics endpoint for the duration of the operation. Unset
+// (the default), no listener is started.
+const metricsAddrEnvVar = "RUNCMD_METRICS_ADDR"
+
+var (
+	scriptDownloadAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runcmd_script_download_attempts_total",
+		Help: "Number of script download attempts, by auth mode.",
+	}, []string{"auth_mode"})
+
+	scriptDownloadFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runcmd_script_download_failures_total",
+		Help: "Number of failed script downloads, by auth mode.",
+	}, []string{"auth_mode"})
+
+	scriptDecodeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runcmd_script_decode_failures_total",
+		Help: "Number of inline script decode failures, by codec.",
+	}, []string{"codec"})
+
+	runCmdDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "runcmd_run_duration_seconds",
+		Help: "Time taken for runCmd to execute a script, in seconds.",
+	})
+
+	cmdInvocationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "runcmd_cmd_invocations_total",
+		Help: "Number of times each subcommand has been invoked.",
+	}, []string{"command"})
+)
+
+// startMetricsListener starts an HTTP listener serving /metrics on the
+// address named by RUNCMD_METRICS_ADDR, if set, and returns a function
+// that shuts it down. When the env var is unset it is a no-op, so the
+// listener never leaks between sequential extension invocations.
+func startMetricsListener(ctx *log.Context) func() {
+	addr := os.Getenv(metricsAddrEnvVar)
+	if addr == "" {
+		return func() {}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			ctx.Log("event", "metrics listener failed", "error", err)
+		}
+	}()
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			ctx.Log("event", "failed to shut down metrics listener", "error", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_metrics_scrapeAfterEnable(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	hEnv := HandlerEnvironment{Name: "Microsoft.CPlat.Core.RunCommandLinux"}
+	hEnv.HandlerEnvironment.ConfigFolder = filepath.Join(root, "config")
+	hEnv.HandlerEnvironment.LogFolder = filepath.Join(root, "log")
+	for _, d := range []string{hEnv.HandlerEnvironment.ConfigFolder, hEnv.HandlerEnvironment.LogFolder} {
+		require.Nil(t, os.MkdirAll(d, 0700))
+	}
+
+	ctx := log.NewContext(log.NewNopLogger())
+	writeSettings := func(seqNum int, settingsJSON string) {
+		require.Nil(t, ioutil.WriteFile(
+			filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, settingsFileName(seqNum)), []byte(settingsJSON), 0600))
+	}
+
+	// seqNum 0: a successful script download, driving the real dispatch
+	// path's cmd-invocation counter and the download-attempts counter.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("echo metrics\n"))
+	}))
+	defer srv.Close()
+	writeSettings(0, fmt.Sprintf(
+		`{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"source":{"scriptUri":%q}}}}]}`, srv.URL+"/script.sh"))
+	_, err = dispatchCommand(ctx, hEnv, 0, "enable", nil)
+	require.Nil(t, err, "download-backed enable run should succeed so runCmd and cmd counters are populated")
+
+	// seqNum 1: a SAS download failure with no managed identity
+	// configured, driving the download-failures counter.
+	UseMockSASDownloadFailure = true
+	writeSettings(1, fmt.Sprintf(
+		`{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"source":{"scriptUri":%q}}}}]}`, srv.URL+"/script.sh"))
+	_, err = dispatchCommand(ctx, hEnv, 1, "enable", nil)
+	require.NotNil(t, err, "a SAS download failure with no managed identity configured should fail enable")
+	UseMockSASDownloadFailure = false
+
+	// seqNum 2: an unparseable base64 inline script, driving the
+	// decode-failures counter.
+	writeSettings(2, `{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"source":{"scriptBase64":"not valid base64!!"}}}}]}`)
+	_, err = dispatchCommand(ctx, hEnv, 2, "enable", nil)
+	require.NotNil(t, err, "an unparseable base64 script should fail enable")
+
+	addr := "127.0.0.1:19099"
+	require.Nil(t, os.Setenv(metricsAddrEnvVar, addr))
+	defer os.Unsetenv(metricsAddrEnvVar)
+	stop := startMetricsListener(ctx)
+	defer stop()
+
+	var body []byte
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.Nil(t, err)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NotEmpty(t, body, "metrics listener never became reachable")
+
+	text := string(body)
+	require.Contains(t, text, "runcmd_run_duration_seconds")
+	require.Contains(t, text, "runcmd_cmd_invocations_total")
+	require.Contains(t, text, `command="enable"`)
+	require.Contains(t, text, "runcmd_script_download_attempts_total")
+	require.Contains(t, text, `auth_mode="sas"`)
+	require.Contains(t, text, "runcmd_script_download_failures_total")
+	require.Contains(t, text, "runcmd_script_decode_failures_total")
+	require.Contains(t, text, `codec="unknown"`)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	outFileName = "stdout"
+	errFileName = "stderr"
+)
+
+// Executor materializes a script on disk and runs it, capturing
+// stdout/stderr into dir's outFileName/errFileName files. Implementations
+// are platform-specific (unixShellExecutor, windowsPowerShellExecutor)
+// and are selected at compile time by build tag via newExecutor. A zero
+// timeout means the script may run indefinitely.
+type Executor interface {
+	Execute(dir string, content []byte, timeout time.Duration) error
+}
+
+// runCmd resolves the script described by hs.Source (inline, inline
+// base64, or downloaded), verifies its detached signature when one is
+// configured, and hands it to the platform Executor for materialization
+// and execution. name identifies the extension instance for logging
+// purposes.
+func runCmd(ctx *log.Context, dir string, name string, hs *handlerSettings) error {
+	return runCmdWithExecutor(ctx, dir, name, hs, newExecutor())
+}
+
+// runCmdWithExecutor is runCmd with the Executor injected, so tests can
+// target a specific platform's executor independent of GOOS.
+func runCmdWithExecutor(ctx *log.Context, dir string, name string, hs *handlerSettings, executor Executor) (err error) {
+	ctx.Log("event", "executing command", "name", name, "output", dir)
+	start := time.Now()
+	defer func() {
+		runCmdDurationSeconds.Observe(time.Since(start).Seconds())
+		if err != nil {
+			ctx.Log("event", "failed to execute command", "error", err)
+		}
+	}()
+
+	content, err := resolveScriptContent(ctx, dir, hs)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve script content")
+	}
+
+	if err := verifyScriptSignature(content, hs); err != nil {
+		return err
+	}
+
+	timeout := time.Duration(hs.TimeoutInSeconds) * time.Second
+	return executor.Execute(dir, content, timeout)
+}
+
+// resolveScriptContent returns the literal bytes of the script to be
+// executed, downloading or base64-decoding it as needed.
+func resolveScriptContent(ctx *log.Context, dir string, hs *handlerSettings) ([]byte, error) {
+	switch {
+	case hs.Source.Script != "":
+		return []byte(hs.Source.Script), nil
+	case hs.Source.ScriptBase64 != "":
+		decoded, info, err := decodeScript(hs.Source.ScriptBase64)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode inline script")
+		}
+		ctx.Log("event", "decoded inline script", "info", info)
+		return []byte(decoded), nil
+	case hs.Source.ScriptURI != "":
+		fp, err := downloadScript(ctx, dir, hs)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to download script")
+		}
+		return ioutil.ReadFile(fp)
+	default:
+		return nil, errors.New("source must specify script, scriptBase64, or scriptUri")
+	}
+}
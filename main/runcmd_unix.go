@@ -0,0 +1,61 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const scriptFileName = "script.sh"
+
+// unixShellExecutor materializes a script as script.sh and runs it via
+// /bin/sh.
+type unixShellExecutor struct{}
+
+func newExecutor() Executor {
+	return unixShellExecutor{}
+}
+
+func (unixShellExecutor) Execute(dir string, content []byte, timeout time.Duration) error {
+	scriptFilePath := filepath.Join(dir, scriptFileName)
+	if err := ioutil.WriteFile(scriptFilePath, content, 0744); err != nil {
+		return errors.Wrap(err, "failed to write script file")
+	}
+
+	outF, err := os.OpenFile(filepath.Join(dir, outFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open stdout file")
+	}
+	defer outF.Close()
+
+	errF, err := os.OpenFile(filepath.Join(dir, errFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open stderr file")
+	}
+	defer errF.Close()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", scriptFilePath)
+	cmd.Stdout = outF
+	cmd.Stderr = errF
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("command timed out after %s", timeout)
+		}
+		return errors.Wrap(err, "failed to execute command")
+	}
+	return nil
+}
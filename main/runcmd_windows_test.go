@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runCmd_success(t *testing.T) {
+	var script = "Get-Date"
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmdWithExecutor(log.NewContext(log.NewNopLogger()), dir, "", &handlerSettings{
+		publicSettings: publicSettings{Source: &scriptSource{Script: script}},
+	}, windowsPowerShellExecutor{})
+	require.Nil(t, err, "command should run successfully")
+
+	// check stdout stderr files
+	_, err = os.Stat(filepath.Join(dir, "stdout"))
+	require.Nil(t, err, "stdout should exist")
+	_, err = os.Stat(filepath.Join(dir, "stderr"))
+	require.Nil(t, err, "stderr should exist")
+
+	// Check embedded script if saved to file
+	_, err = os.Stat(filepath.Join(dir, "script.ps1"))
+	require.Nil(t, err, "script.ps1 should exist")
+	content, err := ioutil.ReadFile(filepath.Join(dir, "script.ps1"))
+	require.Nil(t, err, "script.ps1 read failure")
+	require.Equal(t, script, string(content))
+}
+
+func Test_runCmd_fail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = runCmdWithExecutor(log.NewContext(log.NewNopLogger()), dir, "", &handlerSettings{
+		publicSettings: publicSettings{Source: &scriptSource{Script: "Non-ExistingCmdlet"}},
+	}, windowsPowerShellExecutor{})
+	require.NotNil(t, err, "command terminated with exit status")
+	require.Contains(t, err.Error(), "failed to execute command")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// checkAndSaveSeqNum decides whether seq has already been processed
+// according to the sequence number persisted at fp. When seq is new it
+// is saved and shouldExit is false; when seq has already been handled
+// (or is older than what was last processed) shouldExit is true and the
+// caller should skip re-running the operation.
+func checkAndSaveSeqNum(ctx log.Logger, seq int, fp string) (shouldExit bool, _ error) {
+	prev, exists, err := findSeqNum(fp)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to find sequence number")
+	}
+	if exists && prev >= seq {
+		return true, nil
+	}
+
+	if err := saveSeqNum(fp, seq); err != nil {
+		return false, errors.Wrap(err, "failed to save sequence number")
+	}
+	return false, nil
+}
+
+func findSeqNum(fp string) (seq int, exists bool, _ error) {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	seq, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "sequence number file %s is corrupt", fp)
+	}
+	return seq, true, nil
+}
+
+func saveSeqNum(fp string, seq int) error {
+	return ioutil.WriteFile(fp, []byte(strconv.Itoa(seq)), 0644)
+}
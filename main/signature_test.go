@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	stderrors "errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func Test_runCmd_signatureVerification_validSignaturePasses(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	sig := ed25519.Sign(priv, []byte(script))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			w.Write(sig)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hs := &handlerSettings{
+		publicSettings: publicSettings{
+			Source: &scriptSource{
+				Script:             script,
+				SourceSignatureURI: srv.URL + "/script.sig",
+			},
+		},
+		protectedSettings: protectedSettings{
+			TrustedPublicKeys:  []string{base64.StdEncoding.EncodeToString(pub)},
+			SignatureAlgorithm: SignatureAlgorithmCosignEd25519,
+		},
+	}
+
+	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", hs)
+	require.Nil(t, err, "a signature from a trusted key should be accepted")
+
+	_, err = os.Stat(filepath.Join(dir, scriptFileName))
+	require.Nil(t, err, "%s should be materialized once verification passes", scriptFileName)
+}
+
+func Test_runCmd_signatureVerification_untrustedKeyFails(t *testing.T) {
+	_, signerKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	trustedPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	sig := ed25519.Sign(signerKey, []byte(script))
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hs := &handlerSettings{
+		publicSettings: publicSettings{
+			Source: &scriptSource{
+				Script:          script,
+				SignatureBase64: base64.StdEncoding.EncodeToString(sig),
+			},
+		},
+		protectedSettings: protectedSettings{
+			TrustedPublicKeys:  []string{base64.StdEncoding.EncodeToString(trustedPub)},
+			SignatureAlgorithm: SignatureAlgorithmCosignEd25519,
+		},
+	}
+
+	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", hs)
+	require.NotNil(t, err, "a signature from an untrusted key must be rejected")
+	require.True(t, stderrors.Is(err, ErrSignatureVerificationFailed))
+
+	_, statErr := os.Stat(filepath.Join(dir, scriptFileName))
+	require.True(t, os.IsNotExist(statErr), "script should never be materialized when signature verification fails")
+}
+
+// armoredPublicKey ASCII-armors entity's public key the way a
+// trustedPublicKeys entry is expected to be supplied.
+func armoredPublicKey(t *testing.T, entity *openpgp.Entity) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.Nil(t, err)
+	require.Nil(t, entity.Serialize(w))
+	require.Nil(t, w.Close())
+	return buf.String()
+}
+
+func Test_runCmd_signatureVerification_gpgValidSignaturePasses(t *testing.T) {
+	entity, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", nil)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	var sig bytes.Buffer
+	require.Nil(t, openpgp.DetachSign(&sig, entity, strings.NewReader(script), nil))
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hs := &handlerSettings{
+		publicSettings: publicSettings{
+			Source: &scriptSource{
+				Script:          script,
+				SignatureBase64: base64.StdEncoding.EncodeToString(sig.Bytes()),
+			},
+		},
+		protectedSettings: protectedSettings{
+			TrustedPublicKeys: []string{armoredPublicKey(t, entity)},
+			// SignatureAlgorithm left unset to exercise the default GPG path.
+		},
+	}
+
+	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", hs)
+	require.Nil(t, err, "a signature from a trusted GPG key should be accepted")
+
+	_, err = os.Stat(filepath.Join(dir, scriptFileName))
+	require.Nil(t, err, "%s should be materialized once verification passes", scriptFileName)
+}
+
+func Test_runCmd_signatureVerification_gpgUntrustedKeyFails(t *testing.T) {
+	signer, err := openpgp.NewEntity("Signer", "", "signer@example.com", nil)
+	require.Nil(t, err)
+	trusted, err := openpgp.NewEntity("Trusted", "", "trusted@example.com", nil)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	var sig bytes.Buffer
+	require.Nil(t, openpgp.DetachSign(&sig, signer, strings.NewReader(script), nil))
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hs := &handlerSettings{
+		publicSettings: publicSettings{
+			Source: &scriptSource{
+				Script:          script,
+				SignatureBase64: base64.StdEncoding.EncodeToString(sig.Bytes()),
+			},
+		},
+		protectedSettings: protectedSettings{
+			TrustedPublicKeys:  []string{armoredPublicKey(t, trusted)},
+			SignatureAlgorithm: SignatureAlgorithmGPG,
+		},
+	}
+
+	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", hs)
+	require.NotNil(t, err, "a signature from an untrusted GPG key must be rejected")
+	require.True(t, stderrors.Is(err, ErrSignatureVerificationFailed))
+
+	_, statErr := os.Stat(filepath.Join(dir, scriptFileName))
+	require.True(t, os.IsNotExist(statErr), "script should never be materialized when signature verification fails")
+}
+
+func Test_runCmd_signatureVerification_gpgSkipsUnparseableTrustedKey(t *testing.T) {
+	trusted, err := openpgp.NewEntity("Trusted", "", "trusted@example.com", nil)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	var sig bytes.Buffer
+	require.Nil(t, openpgp.DetachSign(&sig, trusted, strings.NewReader(script), nil))
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	hs := &handlerSettings{
+		publicSettings: publicSettings{
+			Source: &scriptSource{
+				Script:          script,
+				SignatureBase64: base64.StdEncoding.EncodeToString(sig.Bytes()),
+			},
+		},
+		protectedSettings: protectedSettings{
+			TrustedPublicKeys:  []string{"not a valid armored key", armoredPublicKey(t, trusted)},
+			SignatureAlgorithm: SignatureAlgorithmGPG,
+		},
+	}
+
+	err = runCmd(log.NewContext(log.NewNopLogger()), dir, "", hs)
+	require.Nil(t, err, "a malformed key elsewhere in trustedPublicKeys must not reject a signature valid for another trusted key")
+}
+
+// generateTestCert returns a self-signed certificate and its RSA private
+// key, both PEM-encoded, for simulating the cert/key pair waagent
+// provisions to decrypt protectedSettings.
+func generateTestCert(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "run-command-handler-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	require.Nil(t, err)
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	return certPEM, keyPEM
+}
+
+// encryptProtectedSettings CMS-encrypts plaintext against certFile the
+// way waagent encrypts protectedSettings for the guest, returning the
+// DER-encoded envelope.
+func encryptProtectedSettings(t *testing.T, certFile string, plaintext []byte) []byte {
+	t.Helper()
+	cmd := exec.Command("openssl", "smime", "-encrypt", "-aes256", "-outform", "DER", certFile)
+	cmd.Stdin = bytes.NewReader(plaintext)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	require.Nil(t, cmd.Run(), "openssl smime encrypt failed: %s", stderr.String())
+	return out.Bytes()
+}
+
+func Test_enable_signatureVerificationFailure_reportsDistinctExitCode(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	hEnv := HandlerEnvironment{Name: "Microsoft.CPlat.Core.RunCommandLinux"}
+	hEnv.HandlerEnvironment.ConfigFolder = filepath.Join(root, "config")
+	hEnv.HandlerEnvironment.StatusFolder = filepath.Join(root, "status")
+	hEnv.HandlerEnvironment.LogFolder = filepath.Join(root, "log")
+	certsDir := filepath.Join(root, "waagent-certs")
+	for _, d := range []string{hEnv.HandlerEnvironment.ConfigFolder, hEnv.HandlerEnvironment.StatusFolder, hEnv.HandlerEnvironment.LogFolder, certsDir} {
+		require.Nil(t, os.MkdirAll(d, 0700))
+	}
+
+	certPEM, keyPEM := generateTestCert(t)
+	const thumbprint = "TESTTHUMBPRINT"
+	certFile := filepath.Join(certsDir, thumbprint+".crt")
+	require.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certsDir, thumbprint+".prv"), keyPEM, 0600))
+
+	prevCertsDir := waagentCertsDir
+	waagentCertsDir = certsDir
+	defer func() { waagentCertsDir = prevCertsDir }()
+
+	_, signerKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	trustedPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	script := "echo signed\n"
+	sig := ed25519.Sign(signerKey, []byte(script))
+
+	protectedPlain, err := json.Marshal(map[string]interface{}{
+		"trustedPublicKeys":  []string{base64.StdEncoding.EncodeToString(trustedPub)},
+		"signatureAlgorithm": string(SignatureAlgorithmCosignEd25519),
+	})
+	require.Nil(t, err)
+	protectedDER := encryptProtectedSettings(t, certFile, protectedPlain)
+
+	publicPlain, err := json.Marshal(map[string]interface{}{
+		"source": map[string]interface{}{
+			"script":          script,
+			"signatureBase64": base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	require.Nil(t, err)
+
+	settingsJSON, err := json.Marshal(map[string]interface{}{
+		"runtimeSettings": []map[string]interface{}{{
+			"handlerSettings": map[string]interface{}{
+				"publicSettings":                  json.RawMessage(publicPlain),
+				"protectedSettings":               base64.StdEncoding.EncodeToString(protectedDER),
+				"protectedSettingsCertThumbprint": thumbprint,
+			},
+		}},
+	})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(
+		filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, "0.settings"), settingsJSON, 0600))
+
+	msg, err := enable(log.NewContext(log.NewNopLogger()), hEnv, 0, nil)
+	require.NotNil(t, err, "a signature from an untrusted key must be rejected")
+	require.True(t, stderrors.Is(err, ErrSignatureVerificationFailed))
+
+	// mirror main()'s own status reporting so this exercises the real
+	// reportStatus/exitCodeFor path, the same way main() does after cmds[...].f runs.
+	msg = err.Error()
+	require.Nil(t, reportStatus(hEnv, 0, StatusError, exitCodeFor(err), "Enable", msg))
+
+	b, err := ioutil.ReadFile(hEnv.statusFilePath(0))
+	require.Nil(t, err)
+	var report statusReport
+	require.Nil(t, json.Unmarshal(b, &report))
+	require.Len(t, report, 1)
+	require.Equal(t, exitCodeSignatureVerificationFailed, report[0].Status.Code)
+}
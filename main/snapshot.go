@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// handlerLogFileName is the waagent-managed log file for this handler,
+// bundled into snapshots best-effort (it may not exist, e.g. in tests).
+const handlerLogFileName = "extension.log"
+
+const osReleaseFilePath = "/etc/os-release"
+
+// snapshotManifest accompanies a diagnostic snapshot tarball as
+// manifest.json, recording enough to let a support engineer (or this
+// handler, right after writing the archive) confirm nothing in it was
+// truncated or tampered with.
+type snapshotManifest struct {
+	ExtensionVersion string            `json:"extensionVersion"`
+	SequenceNumber   int               `json:"sequenceNumber"`
+	OSRelease        string            `json:"osRelease"`
+	Entries          map[string]string `json:"entries"` // archive member name -> sha256 hex
+}
+
+// snapshot bundles the handler's config, status, and per-sequence
+// working directories into a single gzipped tarball alongside a
+// manifest.json of SHA-256 checksums, for support engineers to attach
+// to tickets without hand-collecting files. It accepts "-o <path>" and
+// defaults to a timestamped file under the handler's log folder. The
+// archive is written to a temp file, its checksums are re-verified,
+// and only then is it renamed into place.
+func snapshot(ctx *log.Context, hEnv HandlerEnvironment, seqNum int, args []string) (string, error) {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	out := fs.String("o", "", "path to write the snapshot tarball to")
+	if err := fs.Parse(args); err != nil {
+		return "", errors.Wrap(err, "failed to parse snapshot flags")
+	}
+
+	outPath := *out
+	if outPath == "" {
+		outPath = filepath.Join(hEnv.HandlerEnvironment.LogFolder,
+			fmt.Sprintf("snapshot-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")))
+	}
+
+	if err := writeSnapshot(outPath, hEnv, seqNum); err != nil {
+		return "", errors.Wrap(err, "failed to write snapshot")
+	}
+	return fmt.Sprintf("wrote diagnostic snapshot to %s", outPath), nil
+}
+
+// snapshotEntry pairs a file on disk with the name it should have
+// inside the snapshot archive.
+type snapshotEntry struct {
+	memberName string
+	path       string
+}
+
+// snapshotEntries enumerates the files a snapshot should try to bundle.
+// Most extension invocations will be missing some of these (e.g. no
+// prior sequence has run yet); callers skip entries that don't exist.
+func snapshotEntries(hEnv HandlerEnvironment, seqNum int) []snapshotEntry {
+	var entries []snapshotEntry
+
+	statuses, _ := filepath.Glob(filepath.Join(hEnv.HandlerEnvironment.StatusFolder, "*.status"))
+	for _, p := range statuses {
+		entries = append(entries, snapshotEntry{filepath.Join("status", filepath.Base(p)), p})
+	}
+
+	settings, _ := filepath.Glob(filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, "*.settings"))
+	for _, p := range settings {
+		entries = append(entries, snapshotEntry{filepath.Join("config", filepath.Base(p)), p})
+	}
+
+	entries = append(entries, snapshotEntry{
+		memberName: filepath.Join("config", seqNumFileName),
+		path:       filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, seqNumFileName),
+	})
+
+	downloadDirs, _ := ioutil.ReadDir(filepath.Join(hEnv.HandlerEnvironment.LogFolder, "download"))
+	for _, d := range downloadDirs {
+		if !d.IsDir() {
+			continue
+		}
+		for _, name := range []string{scriptFileName, outFileName, errFileName} {
+			entries = append(entries, snapshotEntry{
+				memberName: filepath.Join("download", d.Name(), name),
+				path:       filepath.Join(hEnv.HandlerEnvironment.LogFolder, "download", d.Name(), name),
+			})
+		}
+	}
+
+	entries = append(entries, snapshotEntry{
+		memberName: handlerLogFileName,
+		path:       filepath.Join(hEnv.HandlerEnvironment.LogFolder, handlerLogFileName),
+	})
+
+	return entries
+}
+
+// writeSnapshot assembles the tarball at outPath: write to a sibling
+// temp file, verify its checksums match the manifest we just wrote, then
+// rename into place so readers never observe a partial archive.
+func writeSnapshot(outPath string, hEnv HandlerEnvironment, seqNum int) error {
+	tmpPath := outPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp snapshot file")
+	}
+	defer os.Remove(tmpPath)
+
+	manifest := snapshotManifest{
+		ExtensionVersion: handlerVersion,
+		SequenceNumber:   seqNum,
+		OSRelease:        readOSRelease(),
+		Entries:          map[string]string{},
+	}
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	for _, e := range snapshotEntries(hEnv, seqNum) {
+		sum, err := addFileToTar(tw, e.memberName, e.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			tw.Close()
+			gw.Close()
+			f.Close()
+			return errors.Wrapf(err, "failed to add %s to snapshot", e.path)
+		}
+		manifest.Entries[e.memberName] = sum
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		tw.Close()
+		gw.Close()
+		f.Close()
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "manifest.json",
+		Mode: 0644,
+		Size: int64(len(manifestBytes)),
+	}); err != nil {
+		tw.Close()
+		gw.Close()
+		f.Close()
+		return errors.Wrap(err, "failed to write manifest header")
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		tw.Close()
+		gw.Close()
+		f.Close()
+		return errors.Wrap(err, "failed to write manifest")
+	}
+
+	if err := tw.Close(); err != nil {
+		gw.Close()
+		f.Close()
+		return errors.Wrap(err, "failed to close tar writer")
+	}
+	if err := gw.Close(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to close gzip writer")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close snapshot file")
+	}
+
+	if err := verifySnapshotChecksums(tmpPath, manifest); err != nil {
+		return errors.Wrap(err, "snapshot verification failed")
+	}
+
+	return os.Rename(tmpPath, outPath)
+}
+
+// addFileToTar writes path into tw as memberName and returns its
+// SHA-256 hex digest.
+func addFileToTar(tw *tar.Writer, memberName, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: memberName,
+		Mode: int64(fi.Mode().Perm()),
+		Size: fi.Size(),
+	}); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifySnapshotChecksums re-reads the archive at path and confirms
+// every member's SHA-256 matches what manifest.Entries recorded.
+func verifySnapshotChecksums(path string, manifest snapshotManifest) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "manifest.json" {
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+
+		want, ok := manifest.Entries[hdr.Name]
+		if !ok {
+			return errors.Errorf("snapshot contains unexpected member %q", hdr.Name)
+		}
+		if sum != want {
+			return errors.Errorf("checksum mismatch for %q", hdr.Name)
+		}
+		seen[hdr.Name] = true
+	}
+	if len(seen) != len(manifest.Entries) {
+		return errors.New("snapshot is missing entries recorded in the manifest")
+	}
+	return nil
+}
+
+// readOSRelease returns the contents of /etc/os-release, or "" if it
+// can't be read (e.g. non-Linux test environments).
+func readOSRelease() string {
+	b, err := ioutil.ReadFile(osReleaseFilePath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_snapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	hEnv := HandlerEnvironment{Name: "Microsoft.CPlat.Core.RunCommandLinux"}
+	hEnv.HandlerEnvironment.ConfigFolder = filepath.Join(root, "config")
+	hEnv.HandlerEnvironment.StatusFolder = filepath.Join(root, "status")
+	hEnv.HandlerEnvironment.LogFolder = filepath.Join(root, "log")
+	for _, d := range []string{
+		hEnv.HandlerEnvironment.ConfigFolder,
+		hEnv.HandlerEnvironment.StatusFolder,
+		hEnv.HandlerEnvironment.LogFolder,
+	} {
+		require.Nil(t, os.MkdirAll(d, 0700))
+	}
+
+	settingsJSON := `{"runtimeSettings":[{"handlerSettings":{"publicSettings":{"source":{"script":"echo snapshot-me"}}}}]}`
+	require.Nil(t, ioutil.WriteFile(
+		filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, "0.settings"), []byte(settingsJSON), 0600))
+	require.Nil(t, ioutil.WriteFile(
+		filepath.Join(hEnv.HandlerEnvironment.ConfigFolder, seqNumFileName), []byte("0"), 0600))
+
+	ctx := log.NewContext(log.NewNopLogger())
+	_, err = enable(ctx, hEnv, 0, nil)
+	require.Nil(t, err, "enable should run the small script successfully")
+
+	outPath := filepath.Join(root, "out.tar.gz")
+	msg, err := snapshot(ctx, hEnv, 0, []string{"-o", outPath})
+	require.Nil(t, err)
+	require.Contains(t, msg, outPath)
+
+	f, err := os.Open(outPath)
+	require.Nil(t, err)
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	require.Nil(t, err)
+	tr := tar.NewReader(gr)
+
+	members := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+		members[hdr.Name] = b
+	}
+
+	require.Contains(t, members, "manifest.json")
+	require.Contains(t, members, filepath.Join("config", "0.settings"))
+	require.Contains(t, members, filepath.Join("config", seqNumFileName))
+	require.Contains(t, members, filepath.Join("download", "0", outFileName))
+	require.Contains(t, members, filepath.Join("download", "0", scriptFileName))
+
+	var manifest snapshotManifest
+	require.Nil(t, json.Unmarshal(members["manifest.json"], &manifest))
+	require.Equal(t, 0, manifest.SequenceNumber)
+
+	for name, want := range manifest.Entries {
+		got, ok := members[name]
+		require.True(t, ok, "manifest references member %q not found in archive", name)
+		sum := sha256.Sum256(got)
+		require.Equal(t, want, hex.EncodeToString(sum[:]), "checksum mismatch for %q", name)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StatusType is the status of a single extension operation as reported
+// back to the platform via the N.status file.
+type StatusType string
+
+const (
+	StatusTransitioning StatusType = "transitioning"
+	StatusError         StatusType = "error"
+	StatusSuccess       StatusType = "success"
+)
+
+type statusReport []statusItem
+
+type statusItem struct {
+	Version      float64     `json:"version"`
+	TimestampUTC string      `json:"timestampUTC"`
+	Status       innerStatus `json:"status"`
+}
+
+type innerStatus struct {
+	Operation        string           `json:"operation"`
+	Status           StatusType       `json:"status"`
+	Code             int              `json:"code"`
+	FormattedMessage formattedMessage `json:"formattedMessage"`
+}
+
+type formattedMessage struct {
+	Lang    string `json:"lang"`
+	Message string `json:"message"`
+}
+
+// reportStatus writes seqNum's N.status file to hEnv's status folder.
+// code is the numeric status code surfaced to the platform; it is 0 on
+// success and a handler-specific non-zero value otherwise so operators
+// can distinguish failure classes without parsing the message text.
+func reportStatus(hEnv HandlerEnvironment, seqNum int, t StatusType, code int, operation, message string) error {
+	if hEnv.HandlerEnvironment.StatusFolder == "" {
+		return nil // no status folder configured (e.g. unit tests); nothing to do
+	}
+
+	report := statusReport{{
+		Version:      1.0,
+		TimestampUTC: time.Now().UTC().Format(time.RFC3339),
+		Status: innerStatus{
+			Operation: operation,
+			Status:    t,
+			Code:      code,
+			FormattedMessage: formattedMessage{
+				Lang:    "en",
+				Message: message,
+			},
+		},
+	}}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal status")
+	}
+	if err := ioutil.WriteFile(hEnv.statusFilePath(seqNum), b, 0644); err != nil {
+		return errors.Wrap(err, "failed to write status file")
+	}
+	return nil
+}